@@ -0,0 +1,592 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disk
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/kms"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// controllerServer implements the CSI ControllerServer for Alibaba Cloud disks.
+type controllerServer struct {
+	client    *ecs.Client
+	kmsClient *kms.Client
+	// kubeClient persists rotated encryption keys into the volume's Secret;
+	// it is nil when the driver isn't running in-cluster, in which case
+	// RotateEncryptionKey returns codes.Unavailable.
+	kubeClient kubernetes.Interface
+	meta       *NodeMetadata
+	region     string
+}
+
+func newControllerServer(client *ecs.Client, kmsClient *kms.Client, kubeClient kubernetes.Interface, meta *NodeMetadata) *controllerServer {
+	return &controllerServer{client: client, kmsClient: kmsClient, kubeClient: kubeClient, meta: meta, region: meta.RegionId}
+}
+
+// CreateVolume creates an ECS disk and, when a snapshot source is given,
+// restores it from that snapshot.
+func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	diskVolArgs, err := getDiskVolumeOptions(req.GetParameters(), cs.meta)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: invalid parameters: %v", err)
+	}
+
+	if source := req.GetVolumeContentSource(); source != nil {
+		if snap := source.GetSnapshot(); snap != nil {
+			diskVolArgs.SnapshotId = snap.GetSnapshotId()
+		} else {
+			return nil, status.Error(codes.InvalidArgument, "CreateVolume: only snapshot volume content source is supported")
+		}
+	}
+
+	if len(diskVolArgs.Disks) > 0 {
+		return cs.createMultiDiskVolume(req, diskVolArgs)
+	}
+
+	requestGB := (req.GetCapacityRange().GetRequiredBytes() + MB_SIZE*1024 - 1) / (MB_SIZE * 1024)
+
+	createDiskRequest := ecs.CreateCreateDiskRequest()
+	createDiskRequest.RegionId = diskVolArgs.RegionId
+	createDiskRequest.ZoneId = diskVolArgs.ZoneId
+	createDiskRequest.DiskName = req.GetName()
+	createDiskRequest.DiskCategory = diskVolArgs.Type
+	createDiskRequest.Size = requests.NewInteger64(requestGB)
+	createDiskRequest.Encrypted = requests.Boolean(strconv.FormatBool(diskVolArgs.Encrypted))
+	if diskVolArgs.SnapshotId != "" {
+		createDiskRequest.SnapshotId = diskVolArgs.SnapshotId
+	}
+	// volumeExpandPolicy is tagged onto the disk itself since
+	// ControllerExpandVolumeRequest carries no StorageClass parameters;
+	// ControllerExpandVolume reads it back via DescribeDisks.
+	createDiskRequest.Tag = &[]ecs.CreateDiskTag{
+		{Key: volumeExpandPolicyTagKey, Value: diskVolArgs.VolumeExpandPolicy},
+	}
+
+	diskResponse, err := cs.client.CreateDisk(createDiskRequest)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "CreateVolume: failed to create disk %s: %v", req.GetName(), err)
+	}
+
+	// encrypted is normalized to a canonical "true"/"false" here so that
+	// NodeStageVolume's strict string comparison can't diverge from the
+	// yes/true/1 forms getDiskVolumeOptions accepts from the StorageClass.
+	volumeContext := copyStringMap(req.GetParameters())
+	volumeContext["encrypted"] = strconv.FormatBool(diskVolArgs.Encrypted)
+	if diskVolArgs.Encrypted {
+		wrappedKey, err := cs.wrapNewDEK(diskVolArgs.KmsProvider, diskVolArgs.KmsKeyId)
+		if err != nil {
+			if errors.Is(err, errKMSUnavailable) {
+				return nil, status.Errorf(codes.Unavailable, "CreateVolume: %v", err)
+			}
+			return nil, status.Errorf(codes.Internal, "CreateVolume: failed to provision encryption key for disk %s: %v", diskResponse.DiskId, err)
+		}
+		volumeContext["encryptionKmsProvider"] = diskVolArgs.KmsProvider
+		volumeContext["encryptionKmsKeyId"] = diskVolArgs.KmsKeyId
+		volumeContext["encryptionWrappedKey"] = wrappedKey
+
+		// Best-effort: also persist the wrapped key into a Secret so
+		// RotateEncryptionKey has somewhere to write the rewrapped key
+		// back to later. A nil kubeClient only disables rotation, it
+		// doesn't block provisioning.
+		if err := cs.writeEncryptionSecret(diskResponse.DiskId, diskVolArgs.KmsProvider, diskVolArgs.KmsKeyId, wrappedKey); err != nil {
+			klog.Warningf("CreateVolume: failed to persist encryption secret for disk %s: %v", diskResponse.DiskId, err)
+		}
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      diskResponse.DiskId,
+			CapacityBytes: requestGB * MB_SIZE * 1024,
+			VolumeContext: volumeContext,
+			ContentSource: req.GetVolumeContentSource(),
+			AccessibleTopology: []*csi.Topology{
+				{
+					Segments: map[string]string{
+						TOPOLOGY_ZONE_KEY: diskVolArgs.ZoneId,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// createMultiDiskVolume provisions every disk in diskVolArgs.Disks
+// atomically: if any CreateDisk call fails with DISK_NOTAVAILABLE or
+// DISK_CONFILICT, the disks already created are rolled back and deleted.
+func (cs *controllerServer) createMultiDiskVolume(req *csi.CreateVolumeRequest, diskVolArgs *diskVolumeArgs) (*csi.CreateVolumeResponse, error) {
+	attachdetachMutex.LockKey(req.GetName())
+	defer attachdetachMutex.UnlockKey(req.GetName())
+
+	var createdDiskIDs []string
+	rollback := func() {
+		for _, diskID := range createdDiskIDs {
+			deleteRequest := ecs.CreateDeleteDiskRequest()
+			deleteRequest.DiskId = diskID
+			if _, err := cs.client.DeleteDisk(deleteRequest); err != nil {
+				klog.Errorf("createMultiDiskVolume: failed to roll back disk %s: %v", diskID, err)
+			}
+		}
+	}
+
+	for i, spec := range diskVolArgs.Disks {
+		createDiskRequest := ecs.CreateCreateDiskRequest()
+		createDiskRequest.RegionId = diskVolArgs.RegionId
+		createDiskRequest.ZoneId = diskVolArgs.ZoneId
+		createDiskRequest.DiskName = fmt.Sprintf("%s-%d", req.GetName(), i)
+		createDiskRequest.Description = spec.Description
+		createDiskRequest.DiskCategory = spec.Category
+		createDiskRequest.Size = requests.NewInteger64(spec.Size)
+		createDiskRequest.Encrypted = requests.Boolean(strconv.FormatBool(spec.Encrypted))
+
+		diskResponse, err := cs.client.CreateDisk(createDiskRequest)
+		if err != nil {
+			if strings.Contains(err.Error(), DISK_NOTAVAILABLE) || strings.Contains(err.Error(), DISK_CONFILICT) {
+				rollback()
+				return nil, status.Errorf(codes.ResourceExhausted, "createMultiDiskVolume: disk %d/%d unavailable, rolled back %d disks: %v", i+1, len(diskVolArgs.Disks), len(createdDiskIDs), err)
+			}
+			rollback()
+			return nil, status.Errorf(codes.Internal, "createMultiDiskVolume: failed to create disk %d/%d: %v", i+1, len(diskVolArgs.Disks), err)
+		}
+		createdDiskIDs = append(createdDiskIDs, diskResponse.DiskId)
+	}
+
+	var totalGB int64
+	for _, spec := range diskVolArgs.Disks {
+		totalGB += spec.Size
+	}
+
+	volumeContext := copyStringMap(req.GetParameters())
+	volumeContext["diskIds"] = strings.Join(createdDiskIDs, ",")
+	if diskVolArgs.RaidLevel != "" {
+		volumeContext["raidLevel"] = diskVolArgs.RaidLevel
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      strings.Join(createdDiskIDs, ","),
+			CapacityBytes: totalGB * MB_SIZE * 1024,
+			VolumeContext: volumeContext,
+			AccessibleTopology: []*csi.Topology{
+				{
+					Segments: map[string]string{
+						TOPOLOGY_ZONE_KEY: diskVolArgs.ZoneId,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// ControllerPublishVolume attaches every disk making up a (possibly
+// multi-disk) volume to the requested node, rolling back any disks
+// already attached if a later attach fails.
+func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	nodeID := req.GetNodeId()
+	if nodeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume: nodeId is empty")
+	}
+
+	diskIDs := strings.Split(req.GetVolumeId(), ",")
+	if raw := req.GetVolumeContext()["diskIds"]; raw != "" {
+		diskIDs = strings.Split(raw, ",")
+	}
+
+	attachdetachMutex.LockKey(nodeID)
+	defer attachdetachMutex.UnlockKey(nodeID)
+
+	if err := cs.checkAttachLimit(nodeID, diskIDs); err != nil {
+		return nil, status.Errorf(codes.ResourceExhausted, "ControllerPublishVolume: %v", err)
+	}
+
+	var attached []string
+	for _, diskID := range diskIDs {
+		alreadyAttached, err := cs.isDiskAttachedToNode(diskID, nodeID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "ControllerPublishVolume: failed to check attach state of disk %s: %v", diskID, err)
+		}
+		if alreadyAttached {
+			// CSI requires ControllerPublishVolume be idempotent; a retry
+			// after e.g. a sidecar restart must succeed, not hit ECS's
+			// own DISK_CONFILICT error for an already-satisfied request.
+			attached = append(attached, diskID)
+			continue
+		}
+
+		attachRequest := ecs.CreateAttachDiskRequest()
+		attachRequest.DiskId = diskID
+		attachRequest.InstanceId = nodeID
+
+		if _, err := cs.client.AttachDisk(attachRequest); err != nil {
+			for _, a := range attached {
+				detachRequest := ecs.CreateDetachDiskRequest()
+				detachRequest.DiskId = a
+				detachRequest.InstanceId = nodeID
+				if _, derr := cs.client.DetachDisk(detachRequest); derr != nil {
+					klog.Errorf("ControllerPublishVolume: failed to roll back attach of disk %s: %v", a, derr)
+				}
+			}
+			if strings.Contains(err.Error(), DISK_CONFILICT) {
+				return nil, status.Errorf(codes.ResourceExhausted, "ControllerPublishVolume: node %s cannot accept disk %s: %v", nodeID, diskID, err)
+			}
+			return nil, status.Errorf(codes.Internal, "ControllerPublishVolume: failed to attach disk %s to node %s: %v", diskID, nodeID, err)
+		}
+		attached = append(attached, diskID)
+	}
+
+	return &csi.ControllerPublishVolumeResponse{}, nil
+}
+
+// isDiskAttachedToNode reports whether diskID is currently attached to
+// nodeID, so ControllerPublishVolume/ControllerUnpublishVolume can treat a
+// retry that finds the volume already in its target state as success
+// instead of surfacing ECS's own conflict error.
+func (cs *controllerServer) isDiskAttachedToNode(diskID, nodeID string) (bool, error) {
+	describeRequest := ecs.CreateDescribeDisksRequest()
+	describeRequest.DiskIds = "[\"" + diskID + "\"]"
+	describeResponse, err := cs.client.DescribeDisks(describeRequest)
+	if err != nil {
+		return false, fmt.Errorf("failed to describe disk %s: %v", diskID, err)
+	}
+	if len(describeResponse.Disks.Disk) == 0 {
+		return false, fmt.Errorf("disk %s not found", diskID)
+	}
+	disk := describeResponse.Disks.Disk[0]
+	return disk.Status == "In_use" && disk.InstanceId == nodeID, nil
+}
+
+// checkAttachLimit returns an error if attaching those of diskIDs not yet
+// attached to nodeID would exceed the attach limit for its instance type, so
+// the external-provisioner can fall back to scheduling on a different node
+// instead of looping on ECS's own DISK_CONFILICT error.
+func (cs *controllerServer) checkAttachLimit(nodeID string, diskIDs []string) error {
+	describeInstRequest := ecs.CreateDescribeInstancesRequest()
+	describeInstRequest.InstanceIds = "[\"" + nodeID + "\"]"
+	instResp, err := cs.client.DescribeInstances(describeInstRequest)
+	if err != nil || len(instResp.Instances.Instance) == 0 {
+		return fmt.Errorf("failed to describe instance %s: %v", nodeID, err)
+	}
+	instanceType := instResp.Instances.Instance[0].InstanceType
+
+	describeDisksRequest := ecs.CreateDescribeDisksRequest()
+	describeDisksRequest.InstanceId = nodeID
+	disksResp, err := cs.client.DescribeDisks(describeDisksRequest)
+	if err != nil {
+		return fmt.Errorf("failed to describe disks attached to node %s: %v", nodeID, err)
+	}
+
+	attachedHere := make(map[string]bool, len(disksResp.Disks.Disk))
+	for _, d := range disksResp.Disks.Disk {
+		attachedHere[d.DiskId] = true
+	}
+	additional := 0
+	for _, diskID := range diskIDs {
+		if !attachedHere[diskID] {
+			additional++
+		}
+	}
+
+	limit := fetchMaxAttachedDisks(cs.client, instanceType)
+	attachedCount := int64(len(disksResp.Disks.Disk))
+	if attachedCount+int64(additional) > limit {
+		return fmt.Errorf("node %s (%s) has %d disks attached and a limit of %d, cannot attach %d more", nodeID, instanceType, attachedCount, limit, additional)
+	}
+	return nil
+}
+
+// ControllerUnpublishVolume detaches every disk making up the volume from
+// the given node.
+func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	nodeID := req.GetNodeId()
+	for _, diskID := range strings.Split(req.GetVolumeId(), ",") {
+		alreadyAttached, err := cs.isDiskAttachedToNode(diskID, nodeID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "ControllerUnpublishVolume: failed to check attach state of disk %s: %v", diskID, err)
+		}
+		if !alreadyAttached {
+			// Already detached (or never attached here): CSI requires
+			// ControllerUnpublishVolume be idempotent.
+			continue
+		}
+
+		detachRequest := ecs.CreateDetachDiskRequest()
+		detachRequest.DiskId = diskID
+		detachRequest.InstanceId = nodeID
+		if _, err := cs.client.DetachDisk(detachRequest); err != nil {
+			return nil, status.Errorf(codes.Internal, "ControllerUnpublishVolume: failed to detach disk %s from node %s: %v", diskID, nodeID, err)
+		}
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// wrapNewDEK generates a fresh data encryption key for a volume and wraps
+// it with the requested KMSProvider, returning the wrapped key encoded as
+// base64 so it can be carried in VolumeContext/PV metadata.
+func (cs *controllerServer) wrapNewDEK(kmsProvider, kmsKeyId string) (string, error) {
+	provider, err := newKMSProvider(kmsProvider, cs.kmsClient)
+	if err != nil {
+		return "", err
+	}
+	dek, err := generateDEK()
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := provider.WrapKey(kmsKeyId, dek)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+func copyStringMap(in map[string]string) map[string]string {
+	out := make(map[string]string, len(in)+3)
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
+
+// CreateSnapshot creates a point-in-time snapshot of an existing disk.
+func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	diskID := req.GetSourceVolumeId()
+	if diskID == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot: sourceVolumeId is empty")
+	}
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot: name is empty")
+	}
+
+	attachdetachMutex.LockKey(diskID)
+	defer attachdetachMutex.UnlockKey(diskID)
+
+	request := ecs.CreateCreateSnapshotRequest()
+	request.DiskId = diskID
+	request.SnapshotName = req.GetName()
+
+	response, err := cs.client.CreateSnapshot(request)
+	if err != nil {
+		if strings.Contains(err.Error(), DISC_CREATING_SNAPSHOT) {
+			return nil, status.Errorf(codes.Aborted, "CreateSnapshot: disk %s is already creating a snapshot, retry later: %v", diskID, err)
+		}
+		return nil, status.Errorf(codes.Internal, "CreateSnapshot: failed to create snapshot for disk %s: %v", diskID, err)
+	}
+
+	snap, err := cs.waitSnapshotReady(response.SnapshotId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "CreateSnapshot: snapshot %s did not become ready: %v", response.SnapshotId, err)
+	}
+
+	return &csi.CreateSnapshotResponse{
+		Snapshot: &csi.Snapshot{
+			SnapshotId:     snap.SnapshotId,
+			SourceVolumeId: diskID,
+			ReadyToUse:     true,
+			SizeBytes:      snapshotSizeBytes(snap),
+		},
+	}, nil
+}
+
+// snapshotSizeBytes converts ecs.Snapshot's string-typed SourceDiskSize (in
+// GiB) to bytes, logging and returning 0 if the SDK ever returns something
+// unparsable rather than failing the whole RPC over a cosmetic field.
+func snapshotSizeBytes(snap ecs.Snapshot) int64 {
+	sizeGB, err := strconv.ParseInt(snap.SourceDiskSize, 10, 64)
+	if err != nil {
+		klog.Warningf("snapshotSizeBytes: snapshot %s has unparsable SourceDiskSize %q: %v", snap.SnapshotId, snap.SourceDiskSize, err)
+		return 0
+	}
+	return sizeGB * MB_SIZE * 1024
+}
+
+// waitSnapshotReady polls DescribeSnapshots with backoff until the snapshot
+// reaches the "accomplished" status, retrying on DISC_CREATING_SNAPSHOT.
+func (cs *controllerServer) waitSnapshotReady(snapshotID string) (ecs.Snapshot, error) {
+	var snap ecs.Snapshot
+	backoff := wait.Backoff{Duration: time.Second, Factor: 2, Steps: 6}
+	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		describeRequest := ecs.CreateDescribeSnapshotsRequest()
+		describeRequest.SnapshotIds = "[\"" + snapshotID + "\"]"
+		describeResponse, err := cs.client.DescribeSnapshots(describeRequest)
+		if err != nil {
+			if strings.Contains(err.Error(), DISC_CREATING_SNAPSHOT) {
+				return false, nil
+			}
+			return false, err
+		}
+		if len(describeResponse.Snapshots.Snapshot) == 0 {
+			return false, nil
+		}
+		snap = describeResponse.Snapshots.Snapshot[0]
+		return snap.Status == "accomplished", nil
+	})
+	return snap, err
+}
+
+// DeleteSnapshot deletes an existing ECS snapshot.
+func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if req.GetSnapshotId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot: snapshotId is empty")
+	}
+
+	request := ecs.CreateDeleteSnapshotRequest()
+	request.SnapshotId = req.GetSnapshotId()
+
+	if _, err := cs.client.DeleteSnapshot(request); err != nil {
+		if strings.Contains(err.Error(), DISC_CREATING_SNAPSHOT) {
+			return nil, status.Errorf(codes.Aborted, "DeleteSnapshot: snapshot %s is still being created, retry later: %v", req.GetSnapshotId(), err)
+		}
+		return nil, status.Errorf(codes.Internal, "DeleteSnapshot: failed to delete snapshot %s: %v", req.GetSnapshotId(), err)
+	}
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// ListSnapshots lists the snapshots known to ECS, optionally filtered by
+// source volume or snapshot id.
+func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	request := ecs.CreateDescribeSnapshotsRequest()
+	if req.GetSourceVolumeId() != "" {
+		request.DiskId = req.GetSourceVolumeId()
+	}
+	if req.GetSnapshotId() != "" {
+		request.SnapshotIds = "[\"" + req.GetSnapshotId() + "\"]"
+	}
+	if req.GetMaxEntries() != 0 {
+		request.PageSize = requests.NewInteger(int(req.GetMaxEntries()))
+	}
+
+	response, err := cs.client.DescribeSnapshots(request)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "ListSnapshots: failed to describe snapshots: %v", err)
+	}
+
+	entries := make([]*csi.ListSnapshotsResponse_Entry, 0, len(response.Snapshots.Snapshot))
+	for _, snap := range response.Snapshots.Snapshot {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: &csi.Snapshot{
+				SnapshotId:     snap.SnapshotId,
+				SourceVolumeId: snap.SourceDiskId,
+				ReadyToUse:     snap.Status == "accomplished",
+				SizeBytes:      snapshotSizeBytes(snap),
+			},
+		})
+	}
+
+	return &csi.ListSnapshotsResponse{Entries: entries}, nil
+}
+
+// ControllerExpandVolume resizes an ECS disk to the requested capacity,
+// rejecting the request when the disk's category does not support the
+// range being asked for.
+func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	diskID := req.GetVolumeId()
+	if diskID == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume: volumeId is empty")
+	}
+	if strings.Contains(diskID, ",") {
+		// A comma-joined volumeId is a multi-disk volume staged as an LVM
+		// VG or mdraid array; resizing one member disk wouldn't grow the
+		// assembly or its filesystem, so reject instead of silently
+		// operating on only the first disk.
+		return nil, status.Errorf(codes.FailedPrecondition, "ControllerExpandVolume: volume %s is a multi-disk volume, expansion is not supported", diskID)
+	}
+	requestGB := (req.GetCapacityRange().GetRequiredBytes() + MB_SIZE*1024 - 1) / (MB_SIZE * 1024)
+
+	describeRequest := ecs.CreateDescribeDisksRequest()
+	describeRequest.DiskIds = "[\"" + diskID + "\"]"
+	describeResponse, err := cs.client.DescribeDisks(describeRequest)
+	if err != nil || len(describeResponse.Disks.Disk) == 0 {
+		return nil, status.Errorf(codes.NotFound, "ControllerExpandVolume: failed to find disk %s: %v", diskID, err)
+	}
+	disk := describeResponse.Disks.Disk[0]
+
+	sizeRange, ok := diskSizeRangeGB[disk.Category]
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "ControllerExpandVolume: disk category %s does not support resize", disk.Category)
+	}
+	if requestGB < sizeRange[0] || requestGB > sizeRange[1] {
+		return nil, status.Errorf(codes.OutOfRange, "ControllerExpandVolume: requested size %dGB is outside the %s range [%d, %d]", requestGB, disk.Category, sizeRange[0], sizeRange[1])
+	}
+	if disk.Status == "In_use" {
+		volumeExpandPolicy := volumeExpandPolicyFromTags(disk.Tags.Tag)
+		if disk.Category == DISK_COMMON || volumeExpandPolicy != VOLUME_EXPAND_ONLINE {
+			return nil, status.Errorf(codes.FailedPrecondition, "ControllerExpandVolume: disk %s is attached and category %s/volumeExpandPolicy %s does not support online resize; detach it or set volumeExpandPolicy: online", diskID, disk.Category, volumeExpandPolicy)
+		}
+	}
+
+	resizeRequest := ecs.CreateResizeDiskRequest()
+	resizeRequest.DiskId = diskID
+	resizeRequest.NewSize = requests.NewInteger(int(requestGB))
+	if _, err := cs.client.ResizeDisk(resizeRequest); err != nil {
+		return nil, status.Errorf(codes.Internal, "ControllerExpandVolume: failed to resize disk %s: %v", diskID, err)
+	}
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         requestGB * MB_SIZE * 1024,
+		NodeExpansionRequired: true,
+	}, nil
+}
+
+// volumeExpandPolicyFromTags recovers the volumeExpandPolicy CreateVolume
+// tagged the disk with, defaulting to offline when the tag is missing (e.g.
+// disks created before this tag existed).
+func volumeExpandPolicyFromTags(tags []ecs.Tag) string {
+	for _, tag := range tags {
+		if tag.TagKey == volumeExpandPolicyTagKey {
+			return tag.TagValue
+		}
+	}
+	return VOLUME_EXPAND_OFFLINE
+}
+
+// ControllerGetCapabilities returns the capabilities supported by this
+// controller, including snapshot create/list/delete.
+func (cs *controllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	capabilities := []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+	}
+
+	var csc []*csi.ControllerServiceCapability
+	for _, cap := range capabilities {
+		csc = append(csc, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: cap},
+			},
+		})
+	}
+
+	klog.V(4).Infof("ControllerGetCapabilities: %v", csc)
+	return &csi.ControllerGetCapabilitiesResponse{Capabilities: csc}, nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disk
+
+import (
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/kms"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+)
+
+// DiskDriver wires together the CSI controller and node servers for
+// Alibaba Cloud disks.
+type DiskDriver struct {
+	name     string
+	nodeID   string
+	endpoint string
+
+	meta *NodeMetadata
+	cs   *controllerServer
+	ns   *nodeServer
+}
+
+// NewDriver constructs the disk CSI driver, fetching NodeMetadata exactly
+// once so the controller and node servers never hit the IMDS per-request.
+// nodeLabels is the set of labels already present on this node's
+// Kubernetes Node object, used by NodeMetadata as an IMDS fallback.
+func NewDriver(nodeID, endpoint string, nodeLabels map[string]string) *DiskDriver {
+	accessKeyID, accessSecret, accessToken := GetDefaultAK()
+	ecsClient := newEcsClient(accessKeyID, accessSecret, accessToken)
+
+	meta := NewNodeMetadata(nodeLabels)
+	meta.MaxAttachedDisks = fetchMaxAttachedDisks(ecsClient, meta.InstanceType)
+
+	// A nil kmsClient only disables KMS_PROVIDER_ALIBABA; newKMSProvider
+	// rejects it with errKMSUnavailable instead of nil-dereferencing, and
+	// callers map that to codes.Unavailable.
+	kmsClient, err := kms.NewClientWithAccessKey(meta.RegionId, accessKeyID, accessSecret)
+	if err != nil {
+		klog.Warningf("NewDriver: failed to build Alibaba KMS client, KMS_PROVIDER_ALIBABA will be unavailable: %v", err)
+		kmsClient = nil
+	}
+
+	// kubeClient is only used to persist rotated encryption keys back into
+	// the volume's Secret; a nil client degrades RotateEncryptionKey to a
+	// clean Unavailable instead of failing driver startup.
+	var kubeClient kubernetes.Interface
+	kubeConfig, err := rest.InClusterConfig()
+	if err != nil {
+		klog.Warningf("NewDriver: not running in-cluster, RotateEncryptionKey will be unavailable: %v", err)
+	} else if kubeClient, err = kubernetes.NewForConfig(kubeConfig); err != nil {
+		klog.Warningf("NewDriver: failed to build Kubernetes client, RotateEncryptionKey will be unavailable: %v", err)
+		kubeClient = nil
+	}
+
+	return &DiskDriver{
+		name:     KUBERNETES_ALICLOUD_DISK_DRIVER,
+		nodeID:   nodeID,
+		endpoint: endpoint,
+		meta:     meta,
+		cs:       newControllerServer(ecsClient, kmsClient, kubeClient, meta),
+		ns:       newNodeServer(nodeID, kmsClient, meta),
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disk
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// encryptionSecretNamespace holds the per-volume Secrets CreateVolume and
+// RotateEncryptionKey use to persist the wrapped DEK outside of VolumeContext,
+// which is immutable once a PV is provisioned.
+const encryptionSecretNamespace = "kube-system"
+
+func encryptionSecretName(volumeID string) string {
+	return "csi-disk-encryption-" + volumeID
+}
+
+// RotateEncryptionKeyRequest/Response are this driver's own key-rotation
+// types. github.com/csi-addons/spec has no published encryptionkeyrotation
+// addon to implement against, so RotateEncryptionKey is exposed as a plain
+// method rather than an external gRPC service interface; a gRPC front end
+// can be layered on once that addon exists upstream.
+type RotateEncryptionKeyRequest struct {
+	VolumeId string
+	Secrets  map[string]string
+}
+
+type RotateEncryptionKeyResponse struct{}
+
+// RotateEncryptionKey rewraps a volume's data encryption key under a new
+// KMS wrapping key without touching the on-disk LUKS payload.
+func (cs *controllerServer) RotateEncryptionKey(ctx context.Context, req *RotateEncryptionKeyRequest) (*RotateEncryptionKeyResponse, error) {
+	volumeID := req.VolumeId
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "RotateEncryptionKey: volumeId is empty")
+	}
+
+	if cs.kubeClient == nil {
+		return nil, status.Error(codes.Unavailable, "RotateEncryptionKey: no Kubernetes client configured, cannot persist a rotated key")
+	}
+
+	attachdetachMutex.LockKey(volumeID)
+	defer attachdetachMutex.UnlockKey(volumeID)
+
+	secrets := req.Secrets
+	wrappedKey, err := base64.StdEncoding.DecodeString(secrets["encryptionWrappedKey"])
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "RotateEncryptionKey: encryptionWrappedKey is not valid base64: %v", err)
+	}
+
+	oldProvider, err := newKMSProvider(secrets["encryptionKmsProvider"], cs.kmsClient)
+	if err != nil {
+		if errors.Is(err, errKMSUnavailable) {
+			return nil, status.Errorf(codes.Unavailable, "RotateEncryptionKey: %v", err)
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "RotateEncryptionKey: %v", err)
+	}
+	dek, err := oldProvider.UnwrapKey(secrets["encryptionKmsKeyId"], wrappedKey)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "RotateEncryptionKey: failed to unwrap existing DEK for volume %s: %v", volumeID, err)
+	}
+
+	newKeyID := secrets["newEncryptionKmsKeyId"]
+	newProvider, err := newKMSProvider(secrets["newEncryptionKmsProvider"], cs.kmsClient)
+	if err != nil {
+		if errors.Is(err, errKMSUnavailable) {
+			return nil, status.Errorf(codes.Unavailable, "RotateEncryptionKey: %v", err)
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "RotateEncryptionKey: %v", err)
+	}
+	rewrapped, err := newProvider.WrapKey(newKeyID, dek)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "RotateEncryptionKey: failed to rewrap DEK for volume %s: %v", volumeID, err)
+	}
+
+	newKmsProvider := secrets["newEncryptionKmsProvider"]
+	if err := cs.writeEncryptionSecret(volumeID, newKmsProvider, newKeyID, base64.StdEncoding.EncodeToString(rewrapped)); err != nil {
+		return nil, status.Errorf(codes.Internal, "RotateEncryptionKey: failed to persist rotated key for volume %s: %v", volumeID, err)
+	}
+
+	klog.Infof("RotateEncryptionKey: rotated DEK for volume %s from %s/%s to %s/%s", volumeID,
+		secrets["encryptionKmsProvider"], secrets["encryptionKmsKeyId"],
+		newKmsProvider, newKeyID)
+
+	return &RotateEncryptionKeyResponse{}, nil
+}
+
+// writeEncryptionSecret creates or updates the per-volume encryption Secret
+// with the given wrapped key. It is a no-op when cs.kubeClient is nil so
+// CreateVolume can call it best-effort without blocking provisioning.
+func (cs *controllerServer) writeEncryptionSecret(volumeID, kmsProvider, kmsKeyID, wrappedKey string) error {
+	if cs.kubeClient == nil {
+		return nil
+	}
+
+	secretName := encryptionSecretName(volumeID)
+	data := map[string][]byte{
+		"encryptionKmsProvider": []byte(kmsProvider),
+		"encryptionKmsKeyId":    []byte(kmsKeyID),
+		"encryptionWrappedKey":  []byte(wrappedKey),
+	}
+
+	secretsClient := cs.kubeClient.CoreV1().Secrets(encryptionSecretNamespace)
+	if existing, err := secretsClient.Get(secretName, metav1.GetOptions{}); err == nil {
+		existing.Data = data
+		_, err := secretsClient.Update(existing)
+		return err
+	} else if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to read secret %s/%s: %v", encryptionSecretNamespace, secretName, err)
+	}
+
+	_, err := secretsClient.Create(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: encryptionSecretNamespace},
+		Data:       data,
+	})
+	return err
+}
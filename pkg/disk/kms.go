@@ -0,0 +1,161 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disk
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/kms"
+)
+
+const (
+	// DEK_SIZE is the size, in bytes, of the per-volume data encryption key.
+	DEK_SIZE = 32
+
+	KMS_PROVIDER_ALIBABA = "alibaba"
+	KMS_PROVIDER_LOCAL   = "local"
+)
+
+// KMSProvider wraps and unwraps a per-volume data encryption key (DEK). The
+// wrapped key is what gets persisted alongside PV metadata; the plaintext
+// DEK never leaves node memory.
+type KMSProvider interface {
+	WrapKey(keyID string, dek []byte) ([]byte, error)
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// errKMSUnavailable is returned by newKMSProvider when KMS_PROVIDER_ALIBABA
+// is requested but the driver's KMS client failed to initialize at startup.
+// Callers map it to codes.Unavailable instead of a generic Internal error.
+var errKMSUnavailable = errors.New("alibaba KMS client is not available (failed to initialize at driver startup)")
+
+// newKMSProvider returns the KMSProvider registered under name, defaulting
+// to the local file provider when name is empty.
+func newKMSProvider(name string, client *kms.Client) (KMSProvider, error) {
+	switch name {
+	case "", KMS_PROVIDER_LOCAL:
+		return &localFileKMSProvider{masterKeyPath: "/etc/csi-disk/kms-master.key"}, nil
+	case KMS_PROVIDER_ALIBABA:
+		if client == nil {
+			return nil, errKMSUnavailable
+		}
+		return &alibabaKMSProvider{client: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown KMS provider %q", name)
+	}
+}
+
+// alibabaKMSProvider wraps DEKs using Alibaba Cloud KMS envelope encryption.
+type alibabaKMSProvider struct {
+	client *kms.Client
+}
+
+func (p *alibabaKMSProvider) WrapKey(keyID string, dek []byte) ([]byte, error) {
+	request := kms.CreateEncryptRequest()
+	request.KeyId = keyID
+	request.Plaintext = string(dek)
+
+	response, err := p.client.Encrypt(request)
+	if err != nil {
+		return nil, fmt.Errorf("alibaba KMS: failed to encrypt DEK: %v", err)
+	}
+	return []byte(response.CiphertextBlob), nil
+}
+
+func (p *alibabaKMSProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	request := kms.CreateDecryptRequest()
+	request.CiphertextBlob = string(wrapped)
+
+	response, err := p.client.Decrypt(request)
+	if err != nil {
+		return nil, fmt.Errorf("alibaba KMS: failed to decrypt DEK: %v", err)
+	}
+	return []byte(response.Plaintext), nil
+}
+
+// localFileKMSProvider wraps DEKs with AES-GCM under a master key read from
+// a local file. It exists for clusters without access to a managed KMS.
+type localFileKMSProvider struct {
+	masterKeyPath string
+}
+
+func (p *localFileKMSProvider) masterKey() ([]byte, error) {
+	key, err := ioutil.ReadFile(p.masterKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("local KMS: failed to read master key %s: %v", p.masterKeyPath, err)
+	}
+	if len(key) != DEK_SIZE {
+		return nil, fmt.Errorf("local KMS: master key %s must be %d bytes", p.masterKeyPath, DEK_SIZE)
+	}
+	return key, nil
+}
+
+func (p *localFileKMSProvider) WrapKey(keyID string, dek []byte) ([]byte, error) {
+	masterKey, err := p.masterKey()
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("local KMS: failed to generate nonce: %v", err)
+	}
+	return gcm.Seal(nonce, nonce, dek, nil), nil
+}
+
+func (p *localFileKMSProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	masterKey, err := p.masterKey()
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := gcm.NonceSize()
+	if len(wrapped) < nonceSize {
+		return nil, fmt.Errorf("local KMS: wrapped key is shorter than the nonce")
+	}
+	nonce, ciphertext := wrapped[:nonceSize], wrapped[nonceSize:]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("local KMS: failed to create AES cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// generateDEK creates a fresh random data encryption key for a new volume.
+func generateDEK() ([]byte, error) {
+	dek := make([]byte, DEK_SIZE)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, fmt.Errorf("failed to generate data encryption key: %v", err)
+	}
+	return dek, nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disk
+
+import (
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+const (
+	INSTANCE_TYPE_TAG = "instance/instance-type"
+
+	// topology labels kubelet sets on every Node object; used as a
+	// fallback when the IMDS is unreachable (e.g. a non-ECS dev box).
+	NODE_REGION_LABEL = "topology.kubernetes.io/region"
+	NODE_ZONE_LABEL   = "topology.kubernetes.io/zone"
+
+	metadataTimeout    = 2 * time.Second
+	metadataRetrySteps = 4
+)
+
+// NodeMetadata is fetched exactly once at driver startup and threaded
+// through the pieces that used to call GetMetaData on every request.
+type NodeMetadata struct {
+	RegionId     string
+	ZoneId       string
+	InstanceId   string
+	InstanceType string
+	// MaxAttachedDisks is the number of data disks ECS allows to be
+	// attached to this node's instance type, populated via
+	// DescribeInstanceTypes in NewDriver once ecsClient is available.
+	// It falls back to maxVolumesForInstanceType's static table if that
+	// call fails.
+	MaxAttachedDisks int64
+}
+
+// NewNodeMetadata builds a NodeMetadata from the ECS instance metadata
+// service, retrying with backoff on transient failures. When the IMDS is
+// unreachable altogether it falls back to the region/zone topology labels
+// already present on the Kubernetes Node object; InstanceId and
+// InstanceType are left empty in that case.
+func NewNodeMetadata(nodeLabels map[string]string) *NodeMetadata {
+	client := &http.Client{Timeout: metadataTimeout}
+
+	meta := &NodeMetadata{}
+	reachable := true
+	for _, field := range []struct {
+		target   *string
+		resource string
+	}{
+		{&meta.RegionId, REGIONID_TAG},
+		{&meta.ZoneId, ZONEID_TAG},
+		{&meta.InstanceId, INSTANCE_ID},
+		{&meta.InstanceType, INSTANCE_TYPE_TAG},
+	} {
+		value, err := getMetaDataWithRetry(client, field.resource)
+		if err != nil {
+			klog.Warningf("NewNodeMetadata: failed to fetch %s from IMDS: %v", field.resource, err)
+			reachable = false
+			break
+		}
+		*field.target = value
+	}
+
+	if !reachable {
+		klog.Warningf("NewNodeMetadata: IMDS unreachable, falling back to node labels %s/%s", NODE_REGION_LABEL, NODE_ZONE_LABEL)
+		meta.RegionId = nodeLabels[NODE_REGION_LABEL]
+		meta.ZoneId = nodeLabels[NODE_ZONE_LABEL]
+		meta.InstanceId = ""
+		meta.InstanceType = ""
+	}
+
+	return meta
+}
+
+// fetchMaxAttachedDisks queries ECS for the real per-instance-type data
+// disk attach limit via DescribeInstanceTypes, falling back to the static
+// maxVolumesForInstanceType table when the API call fails or the instance
+// type can't be determined (e.g. instanceType is empty because the IMDS
+// was unreachable at startup) or client is nil.
+func fetchMaxAttachedDisks(client *ecs.Client, instanceType string) int64 {
+	if client == nil || instanceType == "" {
+		return maxVolumesForInstanceType(instanceType)
+	}
+
+	request := ecs.CreateDescribeInstanceTypesRequest()
+	request.InstanceTypes = &[]string{instanceType}
+	response, err := client.DescribeInstanceTypes(request)
+	if err != nil || len(response.InstanceTypes.InstanceType) == 0 {
+		klog.Warningf("fetchMaxAttachedDisks: DescribeInstanceTypes failed for %s, falling back to the static table: %v", instanceType, err)
+		return maxVolumesForInstanceType(instanceType)
+	}
+
+	diskQuantity := int64(response.InstanceTypes.InstanceType[0].DiskQuantity)
+	if diskQuantity <= 0 {
+		return maxVolumesForInstanceType(instanceType)
+	}
+	return diskQuantity
+}
+
+// getMetaDataWithRetry fetches a single metadata resource, retrying with
+// exponential backoff since the IMDS can be momentarily unavailable right
+// after an instance boots.
+func getMetaDataWithRetry(client *http.Client, resource string) (string, error) {
+	var result string
+	backoff := wait.Backoff{Duration: 200 * time.Millisecond, Factor: 2, Steps: metadataRetrySteps}
+	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		resp, err := client.Get(METADATA_URL + resource)
+		if err != nil {
+			return false, nil
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return false, nil
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return false, nil
+		}
+		result = string(body)
+		return true, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disk
+
+import (
+	"fmt"
+
+	"github.com/lizebang/csi-plugin/pkg/disk/mountutil"
+)
+
+// Mounter is the seam between the disk package and the host's mount
+// table / exec, so the package can be unit tested without a live shell.
+type Mounter interface {
+	DeviceMountNum(targetPath string) (int, error)
+	IsFileExisting(path string) bool
+	CreateDest(path string) error
+	Mount(devicePath, targetPath, fsType string, options []string) error
+	Unmount(targetPath string) error
+	Exec(command string, args []string) ([]byte, error)
+}
+
+// osMounter is the production Mounter, backed by mountutil and os/exec.
+type osMounter struct{}
+
+func newMounter() Mounter {
+	return &osMounter{}
+}
+
+func (m *osMounter) DeviceMountNum(targetPath string) (int, error) {
+	return mountutil.DeviceMountNum(targetPath)
+}
+
+func (m *osMounter) IsFileExisting(path string) bool {
+	return IsFileExisting(path)
+}
+
+func (m *osMounter) CreateDest(path string) error {
+	return createDest(path)
+}
+
+func (m *osMounter) Mount(devicePath, targetPath, fsType string, options []string) error {
+	args := append([]string{"-t", fsType}, options...)
+	args = append(args, devicePath, targetPath)
+	_, err := execCommand("mount", args)
+	return err
+}
+
+func (m *osMounter) Unmount(targetPath string) error {
+	_, err := execCommand("umount", []string{targetPath})
+	return err
+}
+
+func (m *osMounter) Exec(command string, args []string) ([]byte, error) {
+	return execCommand(command, args)
+}
+
+// fakeMounter is an in-memory Mounter used by unit tests.
+type fakeMounter struct {
+	// mounted maps a target path to the device mounted there.
+	mounted map[string]string
+	// existing tracks paths that IsFileExisting/CreateDest should report
+	// as already present.
+	existing map[string]bool
+	// execResults, keyed by command, is returned by Exec instead of
+	// actually running anything.
+	execResults map[string][]byte
+	execErr     map[string]error
+}
+
+func newFakeMounter() *fakeMounter {
+	return &fakeMounter{
+		mounted:     map[string]string{},
+		existing:    map[string]bool{},
+		execResults: map[string][]byte{},
+		execErr:     map[string]error{},
+	}
+}
+
+func (f *fakeMounter) DeviceMountNum(targetPath string) (int, error) {
+	device, ok := f.mounted[targetPath]
+	if !ok {
+		return 0, nil
+	}
+	count := 0
+	for _, d := range f.mounted {
+		if d == device {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (f *fakeMounter) IsFileExisting(path string) bool {
+	return f.existing[path]
+}
+
+func (f *fakeMounter) CreateDest(path string) error {
+	f.existing[path] = true
+	return nil
+}
+
+func (f *fakeMounter) Mount(devicePath, targetPath, fsType string, options []string) error {
+	f.mounted[targetPath] = devicePath
+	return nil
+}
+
+func (f *fakeMounter) Unmount(targetPath string) error {
+	delete(f.mounted, targetPath)
+	return nil
+}
+
+func (f *fakeMounter) Exec(command string, args []string) ([]byte, error) {
+	if err, ok := f.execErr[command]; ok {
+		return nil, err
+	}
+	if out, ok := f.execResults[command]; ok {
+		return out, nil
+	}
+	return nil, fmt.Errorf("fakeMounter: no result stubbed for command %q", command)
+}
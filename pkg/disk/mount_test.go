@@ -0,0 +1,49 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disk
+
+import "testing"
+
+func TestFakeMounterDeviceMountNum(t *testing.T) {
+	m := newFakeMounter()
+	m.mounted["/mnt/a"] = "/dev/vdb"
+	m.mounted["/mnt/a-bind"] = "/dev/vdb"
+	m.mounted["/mnt/b"] = "/dev/vdc"
+
+	if got, err := m.DeviceMountNum("/mnt/a"); err != nil || got != 2 {
+		t.Errorf("DeviceMountNum(/mnt/a) = %d, %v; want 2, nil", got, err)
+	}
+	if got, err := m.DeviceMountNum("/mnt/unmounted"); err != nil || got != 0 {
+		t.Errorf("DeviceMountNum(/mnt/unmounted) = %d, %v; want 0, nil", got, err)
+	}
+}
+
+func TestFakeMounterMountUnmount(t *testing.T) {
+	m := newFakeMounter()
+	if err := m.Mount("/dev/vdb", "/mnt/a", "ext4", nil); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	if got, err := m.DeviceMountNum("/mnt/a"); err != nil || got != 1 {
+		t.Fatalf("DeviceMountNum after Mount = %d, %v; want 1, nil", got, err)
+	}
+	if err := m.Unmount("/mnt/a"); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+	if got, _ := m.DeviceMountNum("/mnt/a"); got != 0 {
+		t.Errorf("DeviceMountNum after Unmount = %d, want 0", got)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mountutil answers mount-table questions by parsing
+// /proc/self/mountinfo directly, instead of shelling out to "mount".
+package mountutil
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const defaultMountInfoPath = "/proc/self/mountinfo"
+
+// MountPoint is one parsed row of /proc/self/mountinfo.
+type MountPoint struct {
+	// Path is the mount point, field 5.
+	Path string
+	// Source is the mounted device or share, the second field after the
+	// "-" separator (the first is the filesystem type).
+	Source string
+}
+
+// ListMountPoints parses /proc/self/mountinfo.
+func ListMountPoints() ([]MountPoint, error) {
+	f, err := os.Open(defaultMountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", defaultMountInfoPath, err)
+	}
+	defer f.Close()
+	return parseMountInfo(f)
+}
+
+func parseMountInfo(r io.Reader) ([]MountPoint, error) {
+	var mounts []MountPoint
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sepIdx := -1
+		for i, f := range fields {
+			if f == "-" {
+				sepIdx = i
+				break
+			}
+		}
+		// fields[4] is the mount point; the mount source is the second
+		// field after the "-" separator.
+		if sepIdx < 0 || len(fields) < sepIdx+3 || len(fields) < 5 {
+			continue
+		}
+		mounts = append(mounts, MountPoint{
+			Path:   fields[4],
+			Source: fields[sepIdx+2],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse mountinfo: %v", err)
+	}
+	return mounts, nil
+}
+
+// DeviceMountCount returns how many mount points share the same source
+// device as targetPath. It returns 0 when targetPath is not itself
+// mounted.
+func DeviceMountCount(mounts []MountPoint, targetPath string) int {
+	device := ""
+	for _, m := range mounts {
+		if m.Path == targetPath {
+			device = m.Source
+			break
+		}
+	}
+	if device == "" {
+		return 0
+	}
+
+	count := 0
+	for _, m := range mounts {
+		if m.Source == device {
+			count++
+		}
+	}
+	return count
+}
+
+// DeviceMountNum reports how many mounts point at the same device as
+// targetPath, replacing the old "mount | grep" pipeline.
+func DeviceMountNum(targetPath string) (int, error) {
+	mounts, err := ListMountPoints()
+	if err != nil {
+		return 0, err
+	}
+	return DeviceMountCount(mounts, targetPath), nil
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mountutil
+
+import (
+	"strings"
+	"testing"
+)
+
+const sampleMountInfo = `36 35 98:0 / /mnt/disk1 rw,noatime shared:1 - ext4 /dev/vdb rw,errors=remount-ro
+37 35 98:1 / /mnt/disk1-bind rw,noatime shared:1 - ext4 /dev/vdb rw,errors=remount-ro
+38 35 98:2 / /mnt/disk2 rw,noatime shared:1 - ext4 /dev/vdc rw,errors=remount-ro
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, err := parseMountInfo(strings.NewReader(sampleMountInfo))
+	if err != nil {
+		t.Fatalf("parseMountInfo: %v", err)
+	}
+	if len(mounts) != 3 {
+		t.Fatalf("expected 3 mount points, got %d", len(mounts))
+	}
+	if mounts[0].Path != "/mnt/disk1" || mounts[0].Source != "/dev/vdb" {
+		t.Fatalf("unexpected first mount point: %+v", mounts[0])
+	}
+}
+
+func TestDeviceMountCount(t *testing.T) {
+	mounts, err := parseMountInfo(strings.NewReader(sampleMountInfo))
+	if err != nil {
+		t.Fatalf("parseMountInfo: %v", err)
+	}
+
+	if got := DeviceMountCount(mounts, "/mnt/disk1"); got != 2 {
+		t.Errorf("DeviceMountCount(/mnt/disk1) = %d, want 2", got)
+	}
+	if got := DeviceMountCount(mounts, "/mnt/disk2"); got != 1 {
+		t.Errorf("DeviceMountCount(/mnt/disk2) = %d, want 1", got)
+	}
+	if got := DeviceMountCount(mounts, "/mnt/not-mounted"); got != 0 {
+		t.Errorf("DeviceMountCount(/mnt/not-mounted) = %d, want 0", got)
+	}
+}
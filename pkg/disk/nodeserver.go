@@ -0,0 +1,315 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/kms"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// luksMapperPrefix namespaces the /dev/mapper/ device-mapper names this
+// driver creates so they don't collide with unrelated mappings.
+const luksMapperPrefix = "csi-disk-"
+
+// nodeServer implements the CSI NodeServer for Alibaba Cloud disks.
+type nodeServer struct {
+	nodeID    string
+	kmsClient *kms.Client
+	meta      *NodeMetadata
+	mounter   Mounter
+}
+
+func newNodeServer(nodeID string, kmsClient *kms.Client, meta *NodeMetadata) *nodeServer {
+	return &nodeServer{nodeID: nodeID, kmsClient: kmsClient, meta: meta, mounter: newMounter()}
+}
+
+func mapperName(volumeID string) string {
+	return luksMapperPrefix + volumeID
+}
+
+// NodeStageVolume formats and mounts the device at a global staging path.
+// When the volume was provisioned with encrypted=true it first unwraps the
+// volume's DEK and opens a LUKS mapping, staging the mapper device instead
+// of the raw block device.
+func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	devicePath := req.GetPublishContext()["devicePath"]
+	stagingPath := req.GetStagingTargetPath()
+	if volumeID == "" || devicePath == "" || stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume: volumeId, devicePath and stagingTargetPath are required")
+	}
+
+	attachdetachMutex.LockKey(volumeID)
+	defer attachdetachMutex.UnlockKey(volumeID)
+
+	fsType := req.GetVolumeCapability().GetMount().GetFsType()
+	if fsType == "" {
+		fsType = "ext4"
+	}
+
+	volumeContext := req.GetVolumeContext()
+	if raw := volumeContext["diskIds"]; raw != "" {
+		assembledDevice, err := ns.assembleMultiDisk(volumeID, strings.Split(raw, ","), volumeContext["raidLevel"])
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "NodeStageVolume: failed to assemble multi-disk volume %s: %v", volumeID, err)
+		}
+		devicePath = assembledDevice
+	} else if volumeContext["encrypted"] == "true" {
+		mappedDevice, err := ns.openLUKSDevice(volumeID, devicePath, volumeContext)
+		if err != nil {
+			if errors.Is(err, errKMSUnavailable) {
+				return nil, status.Errorf(codes.Unavailable, "NodeStageVolume: %v", err)
+			}
+			return nil, status.Errorf(codes.Internal, "NodeStageVolume: failed to open LUKS device for volume %s: %v", volumeID, err)
+		}
+		devicePath = mappedDevice
+	}
+
+	if err := ns.mounter.CreateDest(stagingPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeStageVolume: failed to create staging path %s: %v", stagingPath, err)
+	}
+
+	if _, verr := ns.mounter.Exec("blkid", []string{devicePath}); verr == nil {
+		klog.Infof("NodeStageVolume: %s already has a filesystem, skipping mkfs", devicePath)
+	} else if _, err := ns.mounter.Exec("mkfs."+fsType, []string{"-F", devicePath}); err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeStageVolume: mkfs.%s failed on %s: %v", fsType, devicePath, err)
+	}
+
+	if err := ns.mounter.Mount(devicePath, stagingPath, fsType, nil); err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeStageVolume: failed to mount %s at %s: %v", devicePath, stagingPath, err)
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// assembleMultiDisk assembles the raw block devices for diskIDs into a
+// single device: an mdraid array when raidLevel is set, otherwise a plain
+// LVM volume group with one logical volume spanning all the disks.
+func (ns *nodeServer) assembleMultiDisk(volumeID string, diskIDs []string, raidLevel string) (string, error) {
+	devices := make([]string, len(diskIDs))
+	for i, diskID := range diskIDs {
+		devices[i] = GetVolumeDeviceName(diskID)
+	}
+
+	switch raidLevel {
+	case RAID_LEVEL_0, RAID_LEVEL_1:
+		return ns.assembleMdraid(volumeID, devices, raidLevel)
+	default:
+		return ns.assembleLVM(volumeID, devices)
+	}
+}
+
+// assemblyName derives a short, stable identifier safe to use in mdadm
+// array names and LVM volume group names. volumeID for a multi-disk volume
+// is the comma-joined disk IDs set by createMultiDiskVolume, and both
+// mdadm and vgcreate reject commas, so the raw volumeID can't be used
+// directly.
+func assemblyName(volumeID string) string {
+	sum := sha256.Sum256([]byte(volumeID))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func (ns *nodeServer) assembleMdraid(volumeID string, devices []string, raidLevel string) (string, error) {
+	mdName := "/dev/md/" + assemblyName(volumeID)
+	level := strings.TrimPrefix(raidLevel, "raid")
+
+	if _, err := ns.mounter.Exec("mdadm", []string{"--detail", mdName}); err == nil {
+		return mdName, nil
+	}
+
+	args := append([]string{
+		"--create", mdName,
+		"--level=" + level,
+		"--raid-devices=" + strconv.Itoa(len(devices)),
+		"--run",
+	}, devices...)
+	if _, err := ns.mounter.Exec("mdadm", args); err != nil {
+		return "", fmt.Errorf("mdadm --create failed: %v", err)
+	}
+	return mdName, nil
+}
+
+func (ns *nodeServer) assembleLVM(volumeID string, devices []string) (string, error) {
+	vgName := "csi-" + assemblyName(volumeID)
+	lvName := "data"
+
+	if _, err := ns.mounter.Exec("vgs", []string{vgName}); err == nil {
+		return "/dev/" + vgName + "/" + lvName, nil
+	}
+
+	if _, err := ns.mounter.Exec("pvcreate", devices); err != nil {
+		return "", fmt.Errorf("pvcreate failed: %v", err)
+	}
+	if _, err := ns.mounter.Exec("vgcreate", append([]string{vgName}, devices...)); err != nil {
+		return "", fmt.Errorf("vgcreate failed: %v", err)
+	}
+	if _, err := ns.mounter.Exec("lvcreate", []string{"-l", "100%FREE", "-n", lvName, vgName}); err != nil {
+		return "", fmt.Errorf("lvcreate failed: %v", err)
+	}
+	return "/dev/" + vgName + "/" + lvName, nil
+}
+
+// openLUKSDevice unwraps the volume's DEK via its KMSProvider and uses it
+// to luksFormat (if needed) and luksOpen the raw device, returning the
+// resulting /dev/mapper/ path.
+func (ns *nodeServer) openLUKSDevice(volumeID, devicePath string, volumeContext map[string]string) (string, error) {
+	wrappedKey, err := base64.StdEncoding.DecodeString(volumeContext["encryptionWrappedKey"])
+	if err != nil {
+		return "", fmt.Errorf("encryptionWrappedKey is not valid base64: %v", err)
+	}
+	provider, err := newKMSProvider(volumeContext["encryptionKmsProvider"], ns.kmsClient)
+	if err != nil {
+		return "", err
+	}
+	dek, err := provider.UnwrapKey(volumeContext["encryptionKmsKeyId"], wrappedKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap DEK: %v", err)
+	}
+
+	mapperDevice := mapperName(volumeID)
+	if _, err := ns.mounter.Exec("blkid", []string{"-t", "TYPE=crypto_LUKS", devicePath}); err != nil {
+		if _, err := runWithStdin(dek, "cryptsetup", "luksFormat", "-q", devicePath, "-"); err != nil {
+			return "", fmt.Errorf("cryptsetup luksFormat failed: %v", err)
+		}
+	}
+	if _, err := runWithStdin(dek, "cryptsetup", "luksOpen", devicePath, mapperDevice, "-d", "-"); err != nil {
+		return "", fmt.Errorf("cryptsetup luksOpen failed: %v", err)
+	}
+	return "/dev/mapper/" + mapperDevice, nil
+}
+
+// NodeUnstageVolume unmounts the staging path and, for encrypted volumes,
+// closes the LUKS mapping opened by NodeStageVolume.
+func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	stagingPath := req.GetStagingTargetPath()
+	if volumeID == "" || stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeUnstageVolume: volumeId and stagingTargetPath are required")
+	}
+
+	attachdetachMutex.LockKey(volumeID)
+	defer attachdetachMutex.UnlockKey(volumeID)
+
+	if ns.mounter.IsFileExisting(stagingPath) {
+		if err := ns.mounter.Unmount(stagingPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "NodeUnstageVolume: failed to unmount %s: %v", stagingPath, err)
+		}
+	}
+
+	mapperPath := "/dev/mapper/" + mapperName(volumeID)
+	if ns.mounter.IsFileExisting(mapperPath) {
+		if _, err := ns.mounter.Exec("cryptsetup", []string{"luksClose", mapperName(volumeID)}); err != nil {
+			return nil, status.Errorf(codes.Internal, "NodeUnstageVolume: failed to close LUKS mapping for volume %s: %v", volumeID, err)
+		}
+	}
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// runWithStdin runs command with args, writing in to its stdin. cryptsetup
+// reads the key material this way instead of via a key file on disk.
+func runWithStdin(in []byte, command string, args ...string) ([]byte, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Stdin = bytes.NewReader(in)
+	return cmd.CombinedOutput()
+}
+
+// NodeExpandVolume grows the filesystem on an already-attached, already
+// resized disk to match the new device size.
+func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	devicePath := req.GetVolumePath()
+	if devicePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume: volumePath is empty")
+	}
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume: volumeId is empty")
+	}
+	if strings.Contains(volumeID, ",") {
+		// Matches the FailedPrecondition rejection in ControllerExpandVolume:
+		// a comma-joined volumeID is an LVM VG or mdraid array assembled from
+		// multiple disks, and resize2fs alone wouldn't grow the assembly
+		// first.
+		return nil, status.Errorf(codes.FailedPrecondition, "NodeExpandVolume: volume %s is a multi-disk volume, expansion is not supported", volumeID)
+	}
+
+	attachdetachMutex.LockKey(volumeID)
+	defer attachdetachMutex.UnlockKey(volumeID)
+
+	fsType := req.GetVolumeCapability().GetMount().GetFsType()
+	if fsType == "" {
+		fsType = "ext4"
+	}
+	if fsType != "ext3" && fsType != "ext4" {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeExpandVolume: unsupported fsType %s, only ext3/ext4 can be resized online", fsType)
+	}
+
+	if _, err := ns.mounter.Exec("resize2fs", []string{devicePath}); err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeExpandVolume: resize2fs failed on %s: %v", devicePath, err)
+	}
+
+	klog.Infof("NodeExpandVolume: resized filesystem on %s for volume %s", devicePath, volumeID)
+	return &csi.NodeExpandVolumeResponse{}, nil
+}
+
+// NodeGetInfo reports this node's instance ID, zone topology, and the
+// maximum number of disks ECS allows to be attached to it.
+func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{
+		NodeId:            ns.nodeID,
+		MaxVolumesPerNode: ns.meta.MaxAttachedDisks,
+		AccessibleTopology: &csi.Topology{
+			Segments: map[string]string{
+				TOPOLOGY_ZONE_KEY: ns.meta.ZoneId,
+			},
+		},
+	}, nil
+}
+
+// NodeGetCapabilities returns the capabilities supported by this node
+// service, including online volume expansion.
+func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	capabilities := []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+	}
+
+	var nsc []*csi.NodeServiceCapability
+	for _, cap := range capabilities {
+		nsc = append(nsc, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{Type: cap},
+			},
+		})
+	}
+
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: nsc}, nil
+}
@@ -17,17 +17,18 @@ limitations under the License.
 package disk
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
-	"strconv"
 	"strings"
 
 	"github.com/aliyun/alibaba-cloud-sdk-go/services/ecs"
 	"github.com/aliyun/alibaba-cloud-sdk-go/services/metadata"
+	"github.com/lizebang/csi-plugin/pkg/disk/mountutil"
 	"k8s.io/kubernetes/pkg/util/keymutex"
 )
 
@@ -49,8 +50,68 @@ const (
 	DISK_SSD                        = "cloud_ssd"
 	MB_SIZE                         = 1024 * 1024
 	DEFAULT_REGION                  = "cn-hangzhou"
+
+	// volumeExpandPolicy values
+	VOLUME_EXPAND_OFFLINE = "offline"
+	VOLUME_EXPAND_ONLINE  = "online"
+
+	// raidLevel values; empty means the disks are assembled as a plain LVM
+	// volume group rather than an mdraid array.
+	RAID_LEVEL_0 = "raid0"
+	RAID_LEVEL_1 = "raid1"
+
+	// TOPOLOGY_ZONE_KEY is the topology key this driver reports from
+	// NodeGetInfo and in CreateVolume's AccessibleTopology.
+	TOPOLOGY_ZONE_KEY = "topology.diskplugin.csi.alibabacloud.com/zone"
+
+	// volumeExpandPolicyTagKey is the ECS disk tag CreateVolume stamps the
+	// disk with so ControllerExpandVolume can recover VolumeExpandPolicy;
+	// ControllerExpandVolumeRequest carries no StorageClass parameters.
+	volumeExpandPolicyTagKey = "csi.alibabacloud.com/volume-expand-policy"
+
+	// DEFAULT_ATTACH_LIMIT is used for instance types not present in
+	// instanceAttachLimits.
+	DEFAULT_ATTACH_LIMIT = 16
 )
 
+// instanceAttachLimits is the fallback used by fetchMaxAttachedDisks when
+// DescribeInstanceTypes can't be called (e.g. no ECS client, or the API
+// call itself fails). Families not listed fall back to DEFAULT_ATTACH_LIMIT.
+var instanceAttachLimits = map[string]int64{
+	"ecs.g6.large":      4,
+	"ecs.g6.xlarge":     8,
+	"ecs.g6.2xlarge":    16,
+	"ecs.g6.4xlarge":    16,
+	"ecs.c6.large":      4,
+	"ecs.c6.xlarge":     8,
+	"ecs.c6.2xlarge":    16,
+	"ecs.r6.large":      4,
+	"ecs.r6.xlarge":     8,
+	"ecs.r6.2xlarge":    16,
+	"ecs.i2.xlarge":     8,
+	"ecs.i2.2xlarge":    16,
+	"ecs.t6-c1m1.large": 3,
+}
+
+// maxVolumesForInstanceType returns the static, hand-maintained attach limit
+// for instanceType, falling back to DEFAULT_ATTACH_LIMIT for unrecognized
+// types. Prefer fetchMaxAttachedDisks, which queries ECS directly and only
+// falls back to this table if that call fails.
+func maxVolumesForInstanceType(instanceType string) int64 {
+	if limit, ok := instanceAttachLimits[instanceType]; ok {
+		return limit
+	}
+	return DEFAULT_ATTACH_LIMIT
+}
+
+// diskSizeRangeGB holds the ECS-documented min/max disk size, in GiB, for a
+// given disk category.
+var diskSizeRangeGB = map[string][2]int64{
+	DISK_COMMON:     {5, 2000},
+	DISK_EFFICIENCY: {20, 32768},
+	DISK_SSD:        {20, 32768},
+}
+
 var (
 	// VERSION should be updated by hand at each release
 	VERSION = "v1.13.2"
@@ -63,7 +124,45 @@ func ProvisionVersion() string {
 	return VERSION
 }
 
-var attachdetachMutex = keymutex.NewKeyMutex()
+// NewHashed(-1) picks a default number of lock stripes; KeyMutex hashes
+// each key (nodeID/volumeID/disk ID) to one of them, so unrelated keys
+// rarely contend while a single map+mutex pair never grows unbounded.
+var attachdetachMutex = keymutex.NewHashed(-1)
+
+// diskVolumeArgs holds the parameters accepted through the StorageClass
+// parameters / CreateVolumeRequest.Parameters map.
+type diskVolumeArgs struct {
+	ZoneId     string
+	RegionId   string
+	FsType     string
+	Type       string
+	ReadOnly   bool
+	Encrypted  bool
+	SnapshotId string
+	// VolumeExpandPolicy is either VOLUME_EXPAND_OFFLINE or VOLUME_EXPAND_ONLINE
+	// and controls whether ControllerExpandVolume may resize an attached disk.
+	VolumeExpandPolicy string
+	// KmsProvider selects the KMSProvider used to wrap the per-volume DEK
+	// when Encrypted is true. Defaults to KMS_PROVIDER_LOCAL.
+	KmsProvider string
+	// KmsKeyId identifies the key/master-key to wrap the DEK with.
+	KmsKeyId string
+	// Disks, when non-empty, requests a PV backed by multiple ECS data
+	// disks created and attached atomically instead of a single disk.
+	Disks []DiskSpec
+	// RaidLevel selects how multiple Disks are assembled on the node:
+	// "" for a plain LVM volume group, or RAID_LEVEL_0/RAID_LEVEL_1 for
+	// an mdraid stripe/mirror.
+	RaidLevel string
+}
+
+// DiskSpec describes one disk in a multi-disk PV's "disks" parameter.
+type DiskSpec struct {
+	Size        int64  `json:"size"`
+	Category    string `json:"category"`
+	Encrypted   bool   `json:"encrypted"`
+	Description string `json:"description"`
+}
 
 // struct for access key
 type DefaultOptions struct {
@@ -153,24 +252,25 @@ func GetLocalAK() (string, string) {
 	return accessKeyID, accessSecret
 }
 
-func GetDeviceMountNum(targetPath string) int {
-	deviceCmd := fmt.Sprintf("mount | grep %s  | grep -v grep | awk '{print $1}'", targetPath)
-	deviceCmdOut, err := run(deviceCmd)
-	if err != nil {
-		return 0
+// GetVolumeDeviceName returns the stable by-id path the virtio-blk device
+// for an ECS disk shows up as on the node.
+func GetVolumeDeviceName(diskID string) string {
+	name := diskID
+	if len(name) > 20 {
+		name = name[:20]
 	}
-	deviceCmdOut = strings.TrimSuffix(deviceCmdOut, "\n")
-	deviceNumCmd := fmt.Sprintf("mount | grep \"%s \" | grep -v grep | wc -l", deviceCmdOut)
-	deviceNumOut, err := run(deviceNumCmd)
+	return "/dev/disk/by-id/virtio-" + name
+}
+
+// GetDeviceMountNum reports how many mounts share the device mounted at
+// targetPath, by parsing /proc/self/mountinfo instead of shelling out to
+// "mount" (which was vulnerable to shell injection via targetPath).
+func GetDeviceMountNum(targetPath string) int {
+	num, err := mountutil.DeviceMountNum(targetPath)
 	if err != nil {
 		return 0
 	}
-	deviceCmdOut = strings.TrimSuffix(deviceCmdOut, "\n")
-	if num, err := strconv.Atoi(deviceNumOut); err != nil {
-		return 0
-	} else {
-		return num
-	}
+	return num
 }
 
 // check file exist in volume driver;
@@ -201,31 +301,26 @@ func IsDirEmpty(name string) (bool, error) {
 	return false, err
 }
 
-func run(cmd string) (string, error) {
-	out, err := exec.Command("sh", "-c", cmd).CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf("Failed to run cmd: %s, with out: %s, error: %s ", cmd, out, err.Error())
-	}
-	return string(out), nil
-}
-
 func execCommand(command string, args []string) ([]byte, error) {
 	cmd := exec.Command(command, args...)
 	return cmd.CombinedOutput()
 }
 
-func getDiskVolumeOptions(volOptions map[string]string) (*diskVolumeArgs, error) {
+// getDiskVolumeOptions parses the StorageClass parameters for a volume.
+// meta supplies the region/zone fallback so callers no longer hit the
+// metadata service on every CreateVolume call.
+func getDiskVolumeOptions(volOptions map[string]string, meta *NodeMetadata) (*diskVolumeArgs, error) {
 	var ok bool
 	diskVolArgs := &diskVolumeArgs{}
 
 	// regionid
 	diskVolArgs.ZoneId, ok = volOptions["zoneId"]
 	if !ok {
-		diskVolArgs.ZoneId = GetMetaData(ZONEID_TAG)
+		diskVolArgs.ZoneId = meta.ZoneId
 	}
 	diskVolArgs.RegionId, ok = volOptions["regionId"]
 	if !ok {
-		diskVolArgs.RegionId = GetMetaData(REGIONID_TAG)
+		diskVolArgs.RegionId = meta.RegionId
 	}
 
 	// fstype
@@ -271,6 +366,38 @@ func getDiskVolumeOptions(volOptions map[string]string) (*diskVolumeArgs, error)
 			diskVolArgs.Encrypted = false
 		}
 	}
+
+	// kmsProvider and kmsKeyId, only meaningful when encrypted is true
+	diskVolArgs.KmsProvider, _ = volOptions["kmsProvider"]
+	diskVolArgs.KmsKeyId, _ = volOptions["kmsKeyId"]
+
+	// snapshotID, used to provision a disk from an existing snapshot
+	diskVolArgs.SnapshotId, _ = volOptions["snapshotID"]
+
+	// disks, a JSON array requesting a multi-disk PV
+	if raw, ok := volOptions["disks"]; ok {
+		var specs []DiskSpec
+		if err := json.Unmarshal([]byte(raw), &specs); err != nil {
+			return nil, fmt.Errorf("illegal required parameter disks: %v", err)
+		}
+		diskVolArgs.Disks = specs
+	}
+
+	// raidLevel, only meaningful when disks has more than one entry
+	diskVolArgs.RaidLevel, _ = volOptions["raidLevel"]
+	if diskVolArgs.RaidLevel != "" && diskVolArgs.RaidLevel != RAID_LEVEL_0 && diskVolArgs.RaidLevel != RAID_LEVEL_1 {
+		return nil, fmt.Errorf("illegal required parameter raidLevel" + diskVolArgs.RaidLevel)
+	}
+
+	// volumeExpandPolicy, honored when the StorageClass sets allowVolumeExpansion
+	diskVolArgs.VolumeExpandPolicy, ok = volOptions["volumeExpandPolicy"]
+	if !ok {
+		diskVolArgs.VolumeExpandPolicy = VOLUME_EXPAND_OFFLINE
+	}
+	if diskVolArgs.VolumeExpandPolicy != VOLUME_EXPAND_OFFLINE && diskVolArgs.VolumeExpandPolicy != VOLUME_EXPAND_ONLINE {
+		return nil, fmt.Errorf("illegal required parameter volumeExpandPolicy" + diskVolArgs.VolumeExpandPolicy)
+	}
+
 	return diskVolArgs, nil
 }
 